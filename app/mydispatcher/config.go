@@ -0,0 +1,112 @@
+package mydispatcher
+
+import (
+	"time"
+
+	"github.com/xcode75/xcore/common/buf"
+	"github.com/xcode75/xcore/common/net"
+)
+
+// Config controls the tunable knobs of DefaultDispatcher. Zero values for
+// every field select the historical hard-coded defaults, so existing
+// deployments behave exactly as before until they opt in.
+type Config struct {
+	// SniffMaxAttempts caps how many times the cached reader is polled
+	// while waiting for enough payload to identify the protocol. Zero
+	// selects the built-in default (2).
+	SniffMaxAttempts int
+	// SniffTimeout bounds each individual read attempt made while
+	// sniffing. Zero selects the built-in default (100ms).
+	SniffTimeout time.Duration
+	// MaxSniffBytes caps how much payload is buffered before sniffing
+	// gives up with errUnknownContent. Zero selects buf.Size.
+	MaxSniffBytes int32
+
+	// HealthCheck, when non-nil, starts the outbound health-check
+	// subsystem used to pick among a route's candidate outbound tags.
+	HealthCheck *HealthCheck
+
+	// CandidateRoutes lets a plain single-tag routing rule opt into
+	// multi-candidate dispatch without the rule/config format upstream
+	// (xcore's router) needing to know about it: a rule that would
+	// otherwise resolve to a tag present here as a key has its route
+	// wrapped so routedDispatch sees the configured Tags/Strategy instead
+	// of just the one tag, the same way a candidateRoute from a future
+	// xcore router would. The key is the outbound tag the underlying
+	// rule/PickRoute call resolves to; Tags is the full candidate list
+	// (the key's own tag may or may not be included) tried in health-order.
+	CandidateRoutes map[string]CandidateGroup
+
+	// RedisLimiter, when non-nil, makes the dispatcher enforce device and
+	// speed limits through limiter.NewRedisBackend instead of the default
+	// process-local backend, so a cluster of nodes shares one device cap
+	// per user.
+	RedisLimiter *RedisLimiterConfig
+}
+
+// RedisLimiterConfig configures the Redis connection used by the
+// distributed Limiter backend.
+type RedisLimiterConfig struct {
+	Address  string
+	Password string
+	DB       int
+}
+
+// HealthCheck configures DefaultDispatcher's outbound health-check
+// subsystem. Tags with no entry here (or a nil HealthCheck altogether)
+// never get probed; routedDispatch falls back to its historical
+// single-tag behavior for routes that don't list candidate tags.
+type HealthCheck struct {
+	// Tags lists every outbound tag that may appear in a route's
+	// candidate list and should therefore be probed.
+	Tags []string
+	// Destination is dialed through each tag's handler to test liveness.
+	Destination net.Destination
+	// Interval between probe rounds. Zero selects 10s.
+	Interval time.Duration
+	// Timeout bounds a single probe dial. Zero selects 3s.
+	Timeout time.Duration
+}
+
+// CandidateGroup is one entry of Config.CandidateRoutes: the candidate
+// outbound tags a matching route should be expanded to, and the strategy
+// HealthChecker.Order should use to arrange them.
+type CandidateGroup struct {
+	Tags     []string
+	Strategy SelectionStrategy
+}
+
+func (c *Config) healthCheckInterval() time.Duration {
+	if c == nil || c.HealthCheck == nil || c.HealthCheck.Interval <= 0 {
+		return 10 * time.Second
+	}
+	return c.HealthCheck.Interval
+}
+
+func (c *Config) healthCheckTimeout() time.Duration {
+	if c == nil || c.HealthCheck == nil || c.HealthCheck.Timeout <= 0 {
+		return 3 * time.Second
+	}
+	return c.HealthCheck.Timeout
+}
+
+func (c *Config) sniffMaxAttempts() int {
+	if c == nil || c.SniffMaxAttempts <= 0 {
+		return 2
+	}
+	return c.SniffMaxAttempts
+}
+
+func (c *Config) sniffTimeout() time.Duration {
+	if c == nil || c.SniffTimeout <= 0 {
+		return time.Millisecond * 100
+	}
+	return c.SniffTimeout
+}
+
+func (c *Config) maxSniffBytes() int32 {
+	if c == nil || c.MaxSniffBytes <= 0 {
+		return buf.Size
+	}
+	return c.MaxSniffBytes
+}
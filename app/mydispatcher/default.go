@@ -34,18 +34,24 @@ var errSniffingTimeout = newError("timeout on sniffing")
 
 type cachedReader struct {
 	sync.Mutex
-	reader *pipe.Reader
-	cache  buf.MultiBuffer
+	reader  *pipe.Reader
+	cache   buf.MultiBuffer
+	timeout time.Duration
 }
 
-func (r *cachedReader) Cache(b *buf.Buffer) {
-	mb, _ := r.reader.ReadMultiBufferTimeout(time.Millisecond * 100)
+// Cache reads whatever's available from the underlying pipe into r's
+// internal cache, then copies up to maxBytes of that cache into b.
+// maxBytes lets a caller configured with a larger Config.MaxSniffBytes
+// than buf.Size (see sniffer, which allocates b accordingly) actually see
+// more payload per call instead of always being capped at buf.Size.
+func (r *cachedReader) Cache(b *buf.Buffer, maxBytes int32) {
+	mb, _ := r.reader.ReadMultiBufferTimeout(r.timeout)
 	r.Lock()
 	if !mb.IsEmpty() {
 		r.cache, _ = buf.MergeMulti(r.cache, mb)
 	}
 	b.Clear()
-	rawBytes := b.Extend(buf.Size)
+	rawBytes := b.Extend(maxBytes)
 	n := r.cache.Copy(rawBytes)
 	b.Resize(0, int32(n))
 	r.Unlock()
@@ -102,6 +108,8 @@ type DefaultDispatcher struct {
 	Limiter     *limiter.Limiter
 	RuleManager *rule.Manager
 	RouterRule  *router_ru.Router
+	config      *Config
+	health      *HealthChecker
 }
 
 func init() {
@@ -125,10 +133,20 @@ func (d *DefaultDispatcher) Init(config *Config, om outbound.Manager, router rou
 	d.router = router
 	d.policy = pm
 	d.stats = sm
-	d.Limiter = limiter.New()
+	d.config = config
+	if config != nil && config.RedisLimiter != nil {
+		d.Limiter = limiter.NewWithBackend(limiter.NewRedisBackend(
+			config.RedisLimiter.Address, config.RedisLimiter.Password, config.RedisLimiter.DB))
+	} else {
+		d.Limiter = limiter.New()
+	}
 	d.RuleManager = rule.New()
 	d.RouterRule = router_ru.NewRouter()
 	d.dns = dns
+	if config != nil && config.HealthCheck != nil {
+		d.health = NewHealthChecker(om, config.HealthCheck.Tags,
+			config.healthCheckInterval(), config.healthCheckTimeout(), config.HealthCheck.Destination)
+	}
 	return nil
 }
 
@@ -138,13 +156,16 @@ func (*DefaultDispatcher) Type() interface{} {
 }
 
 // Start implements common.Runnable.
-func (*DefaultDispatcher) Start() error {
-	return nil
+func (d *DefaultDispatcher) Start() error {
+	return d.health.Start()
 }
 
 // Close implements common.Closable.
-func (*DefaultDispatcher) Close() error {
-	return nil
+func (d *DefaultDispatcher) Close() error {
+	if d.Limiter != nil {
+		d.Limiter.Close()
+	}
+	return d.health.Close()
 }
 
 func (d *DefaultDispatcher) getLink(ctx context.Context, network net.Network, sniffing session.SniffingRequest) (*transport.Link, *transport.Link, error) {
@@ -250,24 +271,29 @@ func (d *DefaultDispatcher) getLink(ctx context.Context, network net.Network, sn
 			inboundLink.Writer = d.Limiter.RateWriter(inboundLink.Writer, bucket)
 			outboundLink.Writer = d.Limiter.RateWriter(outboundLink.Writer, bucket)
 		}
+
+		ip := sessionInbound.Source.Address.IP().String()
+		d.Limiter.RecordDevice(sessionInbound.Tag, user.Email, ip)
+		inboundLink.Writer = &deviceReleaseWriter{
+			Writer:  inboundLink.Writer,
+			release: func() { d.Limiter.ReleaseDevice(sessionInbound.Tag, user.Email, ip) },
+		}
+
 		p := d.policy.ForLevel(user.Level)
-		if p.Stats.UserUplink {
-			name := "user>>>" + user.Email + ">>>traffic>>>uplink"
-			if c, _ := stats.GetOrRegisterCounter(d.stats, name); c != nil {
-				inboundLink.Writer = &SizeStatWriter{
-					Counter: c,
-					Writer:  inboundLink.Writer,
-				}
+		if p.Stats.UserUplink || p.Stats.UserDownlink {
+			// Wrap both directions in a SizeStatWriter even if only one of
+			// UserUplink/UserDownlink is on, so sniffing (which completes
+			// later, in a goroutine) always has somewhere to lazily attach
+			// the per-domain/per-protocol counters from AddCounter.
+			var uplinkCounter, downlinkCounter stats.Counter
+			if p.Stats.UserUplink {
+				uplinkCounter, _ = stats.GetOrRegisterCounter(d.stats, "user>>>"+user.Email+">>>traffic>>>uplink")
 			}
-		}
-		if p.Stats.UserDownlink {
-			name := "user>>>" + user.Email + ">>>traffic>>>downlink"
-			if c, _ := stats.GetOrRegisterCounter(d.stats, name); c != nil {
-				outboundLink.Writer = &SizeStatWriter{
-					Counter: c,
-					Writer:  outboundLink.Writer,
-				}
+			if p.Stats.UserDownlink {
+				downlinkCounter, _ = stats.GetOrRegisterCounter(d.stats, "user>>>"+user.Email+">>>traffic>>>downlink")
 			}
+			inboundLink.Writer = &SizeStatWriter{Counter: uplinkCounter, Writer: inboundLink.Writer}
+			outboundLink.Writer = &SizeStatWriter{Counter: downlinkCounter, Writer: outboundLink.Writer}
 		}
 	}
 
@@ -312,7 +338,7 @@ func (d *DefaultDispatcher) Dispatch(ctx context.Context, destination net.Destin
 	ob := &session.Outbound{
 		Target: destination,
 	}
-	ctx = session.ContextWithOutbound(ctx, ob)
+	ctx = pushOutboundHop(ctx, ob)
 	content := session.ContentFromContext(ctx)
 	if content == nil {
 		content = new(session.Content)
@@ -329,12 +355,14 @@ func (d *DefaultDispatcher) Dispatch(ctx context.Context, destination net.Destin
 	} else {
 		go func() {
 			cReader := &cachedReader{
-				reader: outbound.Reader.(*pipe.Reader),
+				reader:  outbound.Reader.(*pipe.Reader),
+				timeout: d.config.sniffTimeout(),
 			}
 			outbound.Reader = cReader
-			result, err := sniffer(ctx, cReader, sniffingRequest.MetadataOnly, destination.Network)
+			result, err := d.sniffer(ctx, cReader, sniffingRequest.MetadataOnly, destination.Network)
 			if err == nil {
 				content.Protocol = result.Protocol()
+				d.registerDomainProtocolStats(ctx, inbound, outbound, result.Domain(), content.Protocol)
 			}
 			if err == nil && d.shouldOverride(ctx, result, sniffingRequest, destination) {
 				domain := result.Domain()
@@ -360,7 +388,7 @@ func (d *DefaultDispatcher) DispatchLink(ctx context.Context, destination net.De
 	ob := &session.Outbound{
 		Target: destination,
 	}
-	ctx = session.ContextWithOutbound(ctx, ob)
+	ctx = pushOutboundHop(ctx, ob)
 	content := session.ContentFromContext(ctx)
 	if content == nil {
 		content = new(session.Content)
@@ -372,12 +400,14 @@ func (d *DefaultDispatcher) DispatchLink(ctx context.Context, destination net.De
 	} else {
 		go func() {
 			cReader := &cachedReader{
-				reader: outbound.Reader.(*pipe.Reader),
+				reader:  outbound.Reader.(*pipe.Reader),
+				timeout: d.config.sniffTimeout(),
 			}
 			outbound.Reader = cReader
-			result, err := sniffer(ctx, cReader, sniffingRequest.MetadataOnly, destination.Network)
+			result, err := d.sniffer(ctx, cReader, sniffingRequest.MetadataOnly, destination.Network)
 			if err == nil {
 				content.Protocol = result.Protocol()
+				d.registerDomainProtocolStats(ctx, nil, outbound, result.Domain(), content.Protocol)
 			}
 			if err == nil && d.shouldOverride(ctx, result, sniffingRequest, destination) {
 				domain := result.Domain()
@@ -395,8 +425,14 @@ func (d *DefaultDispatcher) DispatchLink(ctx context.Context, destination net.De
 	return nil
 }
 
-func sniffer(ctx context.Context, cReader *cachedReader, metadataOnly bool, network net.Network) (SniffResult, error) {
-	payload := buf.New()
+func (d *DefaultDispatcher) sniffer(ctx context.Context, cReader *cachedReader, metadataOnly bool, network net.Network) (SniffResult, error) {
+	maxSniffBytes := d.config.maxSniffBytes()
+	maxAttempts := d.config.sniffMaxAttempts()
+
+	// maxSniffBytes defaults to buf.Size (see Config.maxSniffBytes), so
+	// this only allocates outside the pooled buf.New() path when a
+	// deployment has actually configured a larger MaxSniffBytes.
+	payload := buf.NewWithSize(maxSniffBytes)
 	defer payload.Release()
 
 	sniffer := NewSniffer(ctx)
@@ -415,18 +451,23 @@ func sniffer(ctx context.Context, cReader *cachedReader, metadataOnly bool, netw
 				return nil, ctx.Err()
 			default:
 				totalAttempt++
-				if totalAttempt > 2 {
+				if totalAttempt > maxAttempts {
 					return nil, errSniffingTimeout
 				}
 
-				cReader.Cache(payload)
+				cReader.Cache(payload, maxSniffBytes)
 				if !payload.IsEmpty() {
+					if network == net.Network_UDP {
+						if result, err := SniffQUIC(payload.Bytes()); err == nil {
+							return result, nil
+						}
+					}
 					result, err := sniffer.Sniff(ctx, payload.Bytes(), network)
 					if err != common.ErrNoClue {
 						return result, err
 					}
 				}
-				if payload.IsFull() {
+				if payload.IsFull() || int32(payload.Len()) >= maxSniffBytes {
 					return nil, errUnknownContent
 				}
 			}
@@ -474,8 +515,13 @@ func (d *DefaultDispatcher) routedDispatch(ctx context.Context, link *transport.
 	routingLink := routingSession.AsRoutingContext(ctx)
 	inTag := routingLink.GetInboundTag()
 	isPickRoute := 0
+	var candidateTags []string
 	if forcedOutboundTag := session.GetForcedOutboundTagFromContext(ctx); forcedOutboundTag != "" {
 		ctx = session.SetForcedOutboundTagToContext(ctx, "")
+		if forcedOutboundTag == hijackDNSOutboundTag {
+			d.serveDNSHijack(ctx, link, destination.Network)
+			return
+		}
 		if h := d.ohm.GetHandler(forcedOutboundTag); h != nil {
 			isPickRoute = 1
 			newError("Taking a detour [", forcedOutboundTag, "] for [", destination, "]").WriteToLog(session.ExportIDToError(ctx))
@@ -488,13 +534,35 @@ func (d *DefaultDispatcher) routedDispatch(ctx context.Context, link *transport.
 		}
 	} else if d.router != nil {
 		if route, err := d.router.PickRoute(routingLink); err == nil {
-			outTag := route.GetOutboundTag()
-			if h := d.ohm.GetHandler(outTag); h != nil {
-				isPickRoute = 2
-				newError("Taking A Detour [", outTag, "] for [", destination, "]").WriteToLog(session.ExportIDToError(ctx))
-				handler = h
+			route = d.withCandidateRoute(route)
+			if cr, ok := route.(candidateRoute); ok && len(cr.GetOutboundTags()) > 0 {
+				ordered := d.health.Order(cr.GetOutboundTags(), cr.GetStrategy())
+				for i, tag := range ordered {
+					if h := d.ohm.GetHandler(tag); h != nil {
+						isPickRoute = 2
+						newError("Taking A Detour [", tag, "] for [", destination, "] (", len(ordered), " candidates)").WriteToLog(session.ExportIDToError(ctx))
+						handler = h
+						// Move the chosen tag to the front so
+						// dispatchWithFailover dials it first and only
+						// falls through to the rest on dial failure.
+						candidateTags = append(append([]string{tag}, ordered[:i]...), ordered[i+1:]...)
+						break
+					}
+				}
 			} else {
-				newError("Non Existing OutboundTag: ", outTag).AtWarning().WriteToLog(session.ExportIDToError(ctx))
+				outTag := route.GetOutboundTag()
+				if outTag == hijackDNSOutboundTag {
+					newError("Hijacking DNS query for [", destination, "]").WriteToLog(session.ExportIDToError(ctx))
+					d.serveDNSHijack(ctx, link, destination.Network)
+					return
+				}
+				if h := d.ohm.GetHandler(outTag); h != nil {
+					isPickRoute = 2
+					newError("Taking A Detour [", outTag, "] for [", destination, "]").WriteToLog(session.ExportIDToError(ctx))
+					handler = h
+				} else {
+					newError("Non Existing OutboundTag: ", outTag).AtWarning().WriteToLog(session.ExportIDToError(ctx))
+				}
 			}
 		} else {
 			newError("Default Route For ", destination).WriteToLog(session.ExportIDToError(ctx))
@@ -517,20 +585,100 @@ func (d *DefaultDispatcher) routedDispatch(ctx context.Context, link *transport.
 		return
 	}
 
-	if accessMessage := log.AccessMessageFromContext(ctx); accessMessage != nil {
-		if tag := handler.Tag(); tag != "" {
-			if inTag == "" {
-				accessMessage.Detour = tag
-			} else if isPickRoute == 1 {
-				accessMessage.Detour = inTag + " ==> " + tag
-			} else if isPickRoute == 2 {
-				accessMessage.Detour = inTag + " -> " + tag
-			} else {
-				accessMessage.Detour = inTag + " >> " + tag
-			}
+	if len(candidateTags) > 1 {
+		// Unlike the single-handler path below, the tag that ends up
+		// relaying this connection isn't known yet - it's whichever
+		// candidate dispatchWithFailover's retry loop lands on - so ob.Tag
+		// and the access log's Detour are recorded there, once that's
+		// decided, instead of here against the first candidate tried.
+		d.dispatchWithFailover(ctx, link, destination, candidateTags, ob, inTag, isPickRoute)
+		return
+	}
+	d.recordHop(ctx, destination, ob, inTag, isPickRoute, handler.Tag())
+	handler.Dispatch(ctx, link)
+}
+
+// recordHop fills in ob.Tag (this hop's entry on the OutboundChain,
+// pushed by pushOutboundHop before the handler was known) and the access
+// log's Detour, now that tag - the outbound that is actually relaying (or,
+// for dispatchWithFailover, did relay) this connection - is known.
+func (d *DefaultDispatcher) recordHop(ctx context.Context, destination net.Destination, ob *session.Outbound, inTag string, isPickRoute int, tag string) {
+	ob.Tag = tag
+	if chain := OutboundChainFromContext(ctx); chain != nil {
+		if hops := chain.Hops(); len(hops) > 1 {
+			newError("Dialing a ", len(hops), "-hop chain for [", destination, "], splice ready: ", chain.AllSpliceReady()).WriteToLog(session.ExportIDToError(ctx))
 		}
-		log.Record(accessMessage)
 	}
 
-	handler.Dispatch(ctx, link)
-}
\ No newline at end of file
+	accessMessage := log.AccessMessageFromContext(ctx)
+	if accessMessage == nil || tag == "" {
+		return
+	}
+	switch {
+	case inTag == "":
+		accessMessage.Detour = tag
+	case isPickRoute == 1:
+		accessMessage.Detour = inTag + " ==> " + tag
+	case isPickRoute == 2:
+		accessMessage.Detour = inTag + " -> " + tag
+	default:
+		accessMessage.Detour = inTag + " >> " + tag
+	}
+	log.Record(accessMessage)
+}
+
+// failoverFastFailThreshold bounds how long a candidate's Dispatch call may
+// run and still be treated as a dial failure (see dispatchWithFailover).
+const failoverFastFailThreshold = 500 * time.Millisecond
+
+// dispatchWithFailover tries each tag in order, giving every candidate its
+// own view of link's reader (via a replayReader, so a candidate that reads
+// some of the client's bytes and then fails doesn't deprive the next
+// candidate of them) and a writer that can't close the caller-facing link
+// out from under a later attempt. It records every outcome back into the
+// health tracker so the next PickRoute call sees it sooner than the next
+// probe round would reveal it.
+//
+// outbound.Handler.Dispatch is void in this codebase, so there's no error
+// return to key a retry decision on; see the comment on HealthChecker.probe
+// for the same problem and the heuristic both use: a candidate that returns
+// quickly having written nothing back to the client is treated as a dial
+// failure, everything else as the real (if not necessarily successful)
+// outcome, so we stop retrying.
+func (d *DefaultDispatcher) dispatchWithFailover(ctx context.Context, link *transport.Link, destination net.Destination, tags []string, ob *session.Outbound, inTag string, isPickRoute int) {
+	replay := &replayReader{reader: link.Reader}
+	writer := noCloseWriter{&countingWriter{inner: link.Writer}}
+
+	succeeded := false
+	for _, tag := range tags {
+		h := d.ohm.GetHandler(tag)
+		if h == nil {
+			continue
+		}
+
+		attemptLink := &transport.Link{Reader: replay.forAttempt(), Writer: writer}
+		newError("Trying candidate outbound [", tag, "] for [", destination, "]").WriteToLog(session.ExportIDToError(ctx))
+
+		before := writer.wrote
+		start := time.Now()
+		h.Dispatch(ctx, attemptLink)
+		elapsed := time.Since(start)
+
+		if elapsed < failoverFastFailThreshold && writer.wrote == before {
+			d.health.RecordFailure(tag)
+			newError("Outbound [", tag, "] returned immediately, trying next candidate").WriteToLog(session.ExportIDToError(ctx))
+			continue
+		}
+
+		d.health.RecordSuccess(tag, elapsed)
+		d.recordHop(ctx, destination, ob, inTag, isPickRoute, tag)
+		succeeded = true
+		break
+	}
+
+	if !succeeded {
+		newError("All candidate outbounds failed for [", destination, "]").AtWarning().WriteToLog(session.ExportIDToError(ctx))
+	}
+	common.Close(link.Writer)
+	common.Interrupt(link.Reader)
+}
@@ -0,0 +1,23 @@
+package mydispatcher
+
+import (
+	"sync"
+
+	"github.com/xcode75/xcore/common"
+	"github.com/xcode75/xcore/common/buf"
+)
+
+// deviceReleaseWriter frees the device slot a connection claimed via
+// Limiter.RecordDevice as soon as its writer side is closed, so a Redis- or
+// memory-backed device count only reflects connections that are still
+// alive.
+type deviceReleaseWriter struct {
+	buf.Writer
+	once    sync.Once
+	release func()
+}
+
+func (w *deviceReleaseWriter) Close() error {
+	w.once.Do(w.release)
+	return common.Close(w.Writer)
+}
@@ -0,0 +1,133 @@
+package mydispatcher
+
+import (
+	"context"
+	"encoding/binary"
+
+	"github.com/xcode75/xcore/common"
+	"github.com/xcode75/xcore/common/buf"
+	"github.com/xcode75/xcore/common/net"
+	"github.com/xcode75/xcore/common/session"
+	"github.com/xcode75/xcore/features/dns"
+	"github.com/xcode75/xcore/transport"
+)
+
+// hijackDNSOutboundTag is the sentinel outbound tag a routing rule uses to
+// select the `hijack-dns` action. It never resolves to a real
+// outbound.Handler; routedDispatch intercepts it before the handler lookup
+// and hands the link to the built-in resolver below instead, the same way
+// forcedOutboundTag is special-cased.
+const hijackDNSOutboundTag = "hijack-dns"
+
+var errNotDNSMessage = newError("not a DNS message")
+
+// serveDNSHijack answers DNS queries arriving on link directly, without a
+// dedicated `dns` outbound handler. This lets a TUN/redirect inbound have
+// its port-53 traffic intercepted transparently. It composes with FakeDNS:
+// if a FakeDNSEngine is configured, hijacked queries are answered with fake
+// pool IPs exactly like a client-side fakedns lookup would be.
+func (d *DefaultDispatcher) serveDNSHijack(ctx context.Context, link *transport.Link, network net.Network) {
+	newError("hijacking DNS query for ", network).WriteToLog(session.ExportIDToError(ctx))
+
+	for {
+		mb, err := link.Reader.ReadMultiBuffer()
+		if err != nil {
+			common.Close(link.Writer)
+			return
+		}
+		for _, b := range mb {
+			query := b.Bytes()
+			if network == net.Network_TCP {
+				query = stripTCPLengthPrefix(query)
+			}
+			if query == nil {
+				continue
+			}
+			resp, err := d.resolveDNSMessage(ctx, query)
+			if err != nil {
+				newError("failed to answer hijacked DNS query").Base(err).WriteToLog(session.ExportIDToError(ctx))
+				continue
+			}
+			out := resp
+			if network == net.Network_TCP {
+				out = addTCPLengthPrefix(resp)
+			}
+			wb := buf.New()
+			wb.Write(out)
+			if network == net.Network_UDP {
+				wb.UDP = b.UDP
+			}
+			if werr := link.Writer.WriteMultiBuffer(buf.MultiBuffer{wb}); werr != nil {
+				buf.ReleaseMulti(mb)
+				common.Close(link.Writer)
+				return
+			}
+		}
+		buf.ReleaseMulti(mb)
+	}
+}
+
+func stripTCPLengthPrefix(b []byte) []byte {
+	if len(b) < 2 {
+		return nil
+	}
+	length := binary.BigEndian.Uint16(b[:2])
+	if int(length) > len(b)-2 {
+		return nil
+	}
+	return b[2 : 2+length]
+}
+
+func addTCPLengthPrefix(b []byte) []byte {
+	out := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(out, uint16(len(b)))
+	copy(out[2:], b)
+	return out
+}
+
+// resolveDNSMessage decodes a single DNS query message, resolves its
+// question via FakeDNS (if configured and the query is in its pool) or
+// d.dns otherwise, and encodes a minimal response carrying the resulting
+// A/AAAA records.
+func (d *DefaultDispatcher) resolveDNSMessage(ctx context.Context, query []byte) ([]byte, error) {
+	id, domain, qtype, err := parseDNSQuestion(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	if fkr0, ok := d.fdns.(dns.FakeDNSEngineRev0); ok {
+		for _, addr := range fkr0.GetFakeIPForDomain(domain) {
+			ips = append(ips, addr.IP())
+		}
+	}
+	// A fake-pool hit only satisfies the query if it actually carries an
+	// address of the requested family: a domain with only an IPv4 fake
+	// entry queried as AAAA must still fall through to d.dns.LookupIP,
+	// otherwise encodeDNSResponse filters ips down to nothing and the
+	// query comes back NXDOMAIN instead of resolving.
+	if !anyMatchesFamily(ips, qtype) {
+		resolved, err := d.dns.LookupIP(domain, dns.IPOption{
+			IPv4Enable: qtype == dnsTypeA,
+			IPv6Enable: qtype == dnsTypeAAAA,
+		})
+		if err != nil {
+			return encodeDNSResponse(id, domain, qtype, nil), nil
+		}
+		ips = resolved
+	}
+
+	return encodeDNSResponse(id, domain, qtype, ips), nil
+}
+
+// anyMatchesFamily reports whether ips contains at least one address of
+// the family qtype asks for (IPv4 for dnsTypeA, IPv6 for dnsTypeAAAA).
+func anyMatchesFamily(ips []net.IP, qtype uint16) bool {
+	for _, ip := range ips {
+		is4 := ip.To4() != nil
+		if (qtype == dnsTypeA && is4) || (qtype == dnsTypeAAAA && !is4) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package mydispatcher
+
+import (
+	"encoding/binary"
+
+	"github.com/xcode75/xcore/common/net"
+)
+
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+)
+
+// parseDNSQuestion decodes the header and first question of a DNS query
+// message. Hijacked traffic is always a single-question query, so
+// anything else is reported as errNotDNSMessage.
+func parseDNSQuestion(b []byte) (id uint16, domain string, qtype uint16, err error) {
+	if len(b) < 12 {
+		return 0, "", 0, errNotDNSMessage
+	}
+	id = binary.BigEndian.Uint16(b[0:2])
+	qdCount := binary.BigEndian.Uint16(b[4:6])
+	if qdCount != 1 {
+		return 0, "", 0, errNotDNSMessage
+	}
+
+	name, offset, err := readDNSName(b, 12)
+	if err != nil {
+		return 0, "", 0, err
+	}
+	if len(b) < offset+4 {
+		return 0, "", 0, errNotDNSMessage
+	}
+	qtype = binary.BigEndian.Uint16(b[offset : offset+2])
+
+	return id, name, qtype, nil
+}
+
+// readDNSName decodes a (possibly compressed) DNS name starting at
+// offset and returns it along with the offset of the byte following it.
+func readDNSName(b []byte, offset int) (string, int, error) {
+	var labels []byte
+	start := offset
+	jumped := false
+	guard := 0
+	for {
+		guard++
+		if guard > 128 || offset >= len(b) {
+			return "", 0, errNotDNSMessage
+		}
+		length := int(b[offset])
+		if length == 0 {
+			offset++
+			break
+		}
+		if length&0xc0 == 0xc0 {
+			if offset+1 >= len(b) {
+				return "", 0, errNotDNSMessage
+			}
+			pointer := int(binary.BigEndian.Uint16(b[offset:offset+2]) & 0x3fff)
+			if !jumped {
+				start = offset + 2
+			}
+			jumped = true
+			offset = pointer
+			continue
+		}
+		if offset+1+length > len(b) {
+			return "", 0, errNotDNSMessage
+		}
+		if len(labels) > 0 {
+			labels = append(labels, '.')
+		}
+		labels = append(labels, b[offset+1:offset+1+length]...)
+		offset += 1 + length
+	}
+	if !jumped {
+		start = offset
+	}
+	return string(labels), start, nil
+}
+
+// encodeDNSResponse builds a minimal DNS response to the query identified
+// by id/domain/qtype, answering with ips (A or AAAA records matching
+// qtype) or NXDOMAIN when ips is empty.
+func encodeDNSResponse(id uint16, domain string, qtype uint16, ips []net.IP) []byte {
+	var answers []net.IP
+	for _, ip := range ips {
+		is4 := ip.To4() != nil
+		if (qtype == dnsTypeA && is4) || (qtype == dnsTypeAAAA && !is4) {
+			answers = append(answers, ip)
+		}
+	}
+
+	rcode := uint16(0)
+	if len(answers) == 0 {
+		rcode = 3 // NXDOMAIN
+	}
+
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[0:2], id)
+	flags := uint16(0x8180) | rcode // QR=1, RD=1, RA=1
+	binary.BigEndian.PutUint16(msg[2:4], flags)
+	binary.BigEndian.PutUint16(msg[4:6], 1)
+	binary.BigEndian.PutUint16(msg[6:8], uint16(len(answers)))
+
+	name := encodeDNSName(domain)
+	msg = append(msg, name...)
+	msg = append(msg, byte(qtype>>8), byte(qtype))
+	msg = append(msg, 0, dnsClassIN)
+
+	for _, ip := range answers {
+		msg = append(msg, 0xc0, 0x0c) // name = pointer to question
+		msg = append(msg, byte(qtype>>8), byte(qtype))
+		msg = append(msg, 0, dnsClassIN)
+		ttl := make([]byte, 4)
+		binary.BigEndian.PutUint32(ttl, 60)
+		msg = append(msg, ttl...)
+		raw := ip.To4()
+		if qtype == dnsTypeAAAA {
+			raw = ip.To16()
+		}
+		rdLen := make([]byte, 2)
+		binary.BigEndian.PutUint16(rdLen, uint16(len(raw)))
+		msg = append(msg, rdLen...)
+		msg = append(msg, raw...)
+	}
+
+	return msg
+}
+
+func encodeDNSName(domain string) []byte {
+	if domain == "" {
+		return []byte{0} // root name
+	}
+	var out []byte
+	start := 0
+	for i := 0; i <= len(domain); i++ {
+		if i == len(domain) || domain[i] == '.' {
+			label := domain[start:i]
+			out = append(out, byte(len(label)))
+			out = append(out, label...)
+			start = i + 1
+		}
+	}
+	out = append(out, 0)
+	return out
+}
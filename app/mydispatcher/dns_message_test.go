@@ -0,0 +1,134 @@
+package mydispatcher
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/xcode75/xcore/common/net"
+)
+
+func buildDNSQuery(id uint16, domain string, qtype uint16) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[0:2], id)
+	binary.BigEndian.PutUint16(msg[4:6], 1) // qdCount
+	msg = append(msg, encodeDNSName(domain)...)
+	msg = append(msg, byte(qtype>>8), byte(qtype))
+	msg = append(msg, 0, dnsClassIN)
+	return msg
+}
+
+func TestEncodeDNSName(t *testing.T) {
+	cases := []struct {
+		domain string
+		want   []byte
+	}{
+		{"example.com", []byte{7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0}},
+		{"a.b.c", []byte{1, 'a', 1, 'b', 1, 'c', 0}},
+		{"", []byte{0}},
+	}
+	for _, c := range cases {
+		got := encodeDNSName(c.domain)
+		if string(got) != string(c.want) {
+			t.Errorf("encodeDNSName(%q) = %v, want %v", c.domain, got, c.want)
+		}
+	}
+}
+
+func TestParseDNSQuestion(t *testing.T) {
+	query := buildDNSQuery(0x1234, "example.com", dnsTypeA)
+
+	id, domain, qtype, err := parseDNSQuestion(query)
+	if err != nil {
+		t.Fatalf("parseDNSQuestion returned error: %v", err)
+	}
+	if id != 0x1234 {
+		t.Errorf("id = %#x, want %#x", id, 0x1234)
+	}
+	if domain != "example.com" {
+		t.Errorf("domain = %q, want %q", domain, "example.com")
+	}
+	if qtype != dnsTypeA {
+		t.Errorf("qtype = %d, want %d", qtype, dnsTypeA)
+	}
+}
+
+func TestParseDNSQuestionRejectsShortOrEmpty(t *testing.T) {
+	if _, _, _, err := parseDNSQuestion(nil); err == nil {
+		t.Error("expected error for empty input")
+	}
+	if _, _, _, err := parseDNSQuestion(make([]byte, 4)); err == nil {
+		t.Error("expected error for a header shorter than 12 bytes")
+	}
+
+	noQuestions := make([]byte, 12)
+	if _, _, _, err := parseDNSQuestion(noQuestions); err == nil {
+		t.Error("expected error when qdCount is zero")
+	}
+}
+
+func TestReadDNSNameWithCompressionPointer(t *testing.T) {
+	// A message where the question's name lives at offset 12, and a
+	// second occurrence right after it is just a pointer back to it.
+	msg := make([]byte, 12)
+	msg = append(msg, encodeDNSName("example.com")...)
+	pointerOffset := len(msg)
+	msg = append(msg, 0xc0, 0x0c) // pointer to offset 12
+
+	name, _, err := readDNSName(msg, 12)
+	if err != nil {
+		t.Fatalf("readDNSName at offset 12 returned error: %v", err)
+	}
+	if name != "example.com" {
+		t.Errorf("name = %q, want %q", name, "example.com")
+	}
+
+	name, next, err := readDNSName(msg, pointerOffset)
+	if err != nil {
+		t.Fatalf("readDNSName at compression pointer returned error: %v", err)
+	}
+	if name != "example.com" {
+		t.Errorf("compressed name = %q, want %q", name, "example.com")
+	}
+	if next != pointerOffset+2 {
+		t.Errorf("next offset = %d, want %d", next, pointerOffset+2)
+	}
+}
+
+func TestEncodeDNSResponse(t *testing.T) {
+	ip := net.ParseAddress("93.184.216.34").IP()
+
+	resp := encodeDNSResponse(0x1234, "example.com", dnsTypeA, []net.IP{ip})
+
+	gotID := binary.BigEndian.Uint16(resp[0:2])
+	if gotID != 0x1234 {
+		t.Errorf("response id = %#x, want %#x", gotID, 0x1234)
+	}
+	ancount := binary.BigEndian.Uint16(resp[6:8])
+	if ancount != 1 {
+		t.Fatalf("ancount = %d, want 1", ancount)
+	}
+
+	name, offset, err := readDNSName(resp, 12)
+	if err != nil {
+		t.Fatalf("readDNSName on response question failed: %v", err)
+	}
+	if name != "example.com" {
+		t.Errorf("question name = %q, want %q", name, "example.com")
+	}
+	qtype := binary.BigEndian.Uint16(resp[offset : offset+2])
+	if qtype != dnsTypeA {
+		t.Errorf("question qtype = %d, want %d", qtype, dnsTypeA)
+	}
+}
+
+func TestEncodeDNSResponseNXDOMAIN(t *testing.T) {
+	resp := encodeDNSResponse(1, "example.com", dnsTypeA, nil)
+
+	flags := binary.BigEndian.Uint16(resp[2:4])
+	if rcode := flags & 0x0f; rcode != 3 {
+		t.Errorf("rcode = %d, want 3 (NXDOMAIN)", rcode)
+	}
+	if ancount := binary.BigEndian.Uint16(resp[6:8]); ancount != 0 {
+		t.Errorf("ancount = %d, want 0", ancount)
+	}
+}
@@ -0,0 +1,96 @@
+package mydispatcher
+
+import (
+	"sync"
+
+	"github.com/xcode75/xcore/common/buf"
+)
+
+// countingWriter forwards every MultiBuffer to inner and tallies the total
+// bytes written, so a caller with no error return from Dispatch to inspect
+// (see health.go's probe and default.go's dispatchWithFailover) can still tell
+// whether anything was ever relayed back.
+type countingWriter struct {
+	inner buf.Writer
+	wrote int64
+}
+
+func (w *countingWriter) WriteMultiBuffer(mb buf.MultiBuffer) error {
+	w.wrote += int64(mb.Len())
+	return w.inner.WriteMultiBuffer(mb)
+}
+
+// replayReader lets dispatchWithFailover hand a client's upstream bytes to
+// more than one candidate outbound in turn: every MultiBuffer it ever reads
+// off the real, single-use underlying reader is kept (as a fresh copy) so a
+// later attempt - after an earlier one dialed, read some of it, then failed
+// - can replay exactly the same bytes before continuing on to whatever the
+// underlying reader hasn't produced yet.
+type replayReader struct {
+	mu      sync.Mutex
+	reader  buf.Reader
+	history []buf.MultiBuffer
+}
+
+// forAttempt returns a fresh view over r for one candidate's attemptLink.
+// Views are meant to be used sequentially (one retry at a time), never
+// concurrently.
+func (r *replayReader) forAttempt() *replayAttemptReader {
+	return &replayAttemptReader{parent: r}
+}
+
+func (r *replayReader) readAt(pos int) (buf.MultiBuffer, int, error) {
+	r.mu.Lock()
+	if pos < len(r.history) {
+		mb := cloneMultiBuffer(r.history[pos])
+		r.mu.Unlock()
+		return mb, pos + 1, nil
+	}
+	r.mu.Unlock()
+
+	mb, err := r.reader.ReadMultiBuffer()
+	if err != nil {
+		return nil, pos, err
+	}
+	r.mu.Lock()
+	r.history = append(r.history, cloneMultiBuffer(mb))
+	newPos := len(r.history)
+	r.mu.Unlock()
+	return mb, newPos, nil
+}
+
+type replayAttemptReader struct {
+	parent *replayReader
+	pos    int
+}
+
+func (a *replayAttemptReader) ReadMultiBuffer() (buf.MultiBuffer, error) {
+	mb, pos, err := a.parent.readAt(a.pos)
+	a.pos = pos
+	return mb, err
+}
+
+func cloneMultiBuffer(mb buf.MultiBuffer) buf.MultiBuffer {
+	out := make(buf.MultiBuffer, 0, len(mb))
+	for _, b := range mb {
+		nb := buf.New()
+		nb.Write(b.Bytes())
+		nb.UDP = b.UDP
+		out = append(out, nb)
+	}
+	return out
+}
+
+// noCloseWriter delegates WriteMultiBuffer but swallows Close, so one
+// candidate's handler tearing down "its" writer on failure doesn't close
+// the caller-facing link.Writer out from under the next candidate.
+// dispatchWithFailover closes the real link.Writer itself, exactly once,
+// after its candidate loop ends (at the first candidate that succeeds, or
+// after the last one fails).
+type noCloseWriter struct {
+	*countingWriter
+}
+
+func (noCloseWriter) Close() error {
+	return nil
+}
@@ -0,0 +1,356 @@
+package mydispatcher
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xcode75/xcore/common"
+	"github.com/xcode75/xcore/common/net"
+	"github.com/xcode75/xcore/common/session"
+	"github.com/xcode75/xcore/features/outbound"
+	"github.com/xcode75/xcore/features/routing"
+	"github.com/xcode75/xcore/transport"
+	"github.com/xcode75/xcore/transport/pipe"
+)
+
+// SelectionStrategy picks one outbound tag out of a route's candidate
+// list based on the HealthChecker's current view of each tag's health.
+type SelectionStrategy string
+
+const (
+	StrategyLeastLatency SelectionStrategy = "leastLatency"
+	StrategyRoundRobin   SelectionStrategy = "roundRobin"
+	StrategyRandom       SelectionStrategy = "random"
+	StrategyFailover     SelectionStrategy = "failover"
+)
+
+// candidateRoute is implemented by routing.Route values that carry more
+// than one candidate outbound tag for routedDispatch to choose among,
+// instead of the usual single, fixed GetOutboundTag(). Routes that don't
+// implement it behave exactly as before.
+type candidateRoute interface {
+	GetOutboundTags() []string
+	GetStrategy() SelectionStrategy
+}
+
+// candidateRouteWrapper adapts a plain routing.Route to candidateRoute by
+// embedding it (promoting GetOutboundTag and everything else routing.Route
+// requires) and adding the two extra methods routedDispatch looks for. See
+// withCandidateRoute, the only place that constructs one.
+type candidateRouteWrapper struct {
+	routing.Route
+	tags     []string
+	strategy SelectionStrategy
+}
+
+func (w *candidateRouteWrapper) GetOutboundTags() []string {
+	return w.tags
+}
+
+func (w *candidateRouteWrapper) GetStrategy() SelectionStrategy {
+	return w.strategy
+}
+
+// withCandidateRoute expands route into a candidateRoute per
+// Config.CandidateRoutes, keyed by the tag route's underlying rule already
+// resolves to. This is the real producer side of the candidate-route
+// subsystem below: without it, nothing in a stock xcore deployment ever
+// implements candidateRoute, and routedDispatch's type assertion would
+// never succeed. A nil route, nil config, or a tag with no configured
+// group is returned unchanged.
+func (d *DefaultDispatcher) withCandidateRoute(route routing.Route) routing.Route {
+	if route == nil || d.config == nil || len(d.config.CandidateRoutes) == 0 {
+		return route
+	}
+	if _, ok := route.(candidateRoute); ok {
+		return route
+	}
+	group, ok := d.config.CandidateRoutes[route.GetOutboundTag()]
+	if !ok || len(group.Tags) == 0 {
+		return route
+	}
+	return &candidateRouteWrapper{Route: route, tags: group.Tags, strategy: group.Strategy}
+}
+
+// ewmaAlpha weighs the most recent probe heavily, so the tracker reacts to
+// a node going bad within a handful of probes instead of hundreds.
+const ewmaAlpha = 0.3
+
+type tagHealth struct {
+	mu        sync.Mutex
+	ewmaRTT   time.Duration
+	alive     bool
+	successes uint64
+	failures  uint64
+}
+
+func (h *tagHealth) recordSuccess(rtt time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.alive = true
+	h.successes++
+	if h.ewmaRTT == 0 {
+		h.ewmaRTT = rtt
+		return
+	}
+	h.ewmaRTT = time.Duration(ewmaAlpha*float64(rtt) + (1-ewmaAlpha)*float64(h.ewmaRTT))
+}
+
+func (h *tagHealth) recordFailure() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.alive = false
+	h.failures++
+}
+
+func (h *tagHealth) snapshot() (alive bool, rtt time.Duration, successRate float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	total := h.successes + h.failures
+	if total == 0 {
+		return true, 0, 1
+	}
+	return h.alive, h.ewmaRTT, float64(h.successes) / float64(total)
+}
+
+// HealthChecker probes every configured outbound tag on an interval and
+// tracks its liveness (EWMA RTT + success rate) so routedDispatch can pick
+// a live handler for a multi-candidate route and reorder the rest as
+// fallbacks for handler.Dispatch failover.
+type HealthChecker struct {
+	ohm         outbound.Manager
+	interval    time.Duration
+	timeout     time.Duration
+	destination net.Destination
+
+	mu    sync.RWMutex
+	tags  map[string]*tagHealth
+	rr    uint64
+	close chan struct{}
+	wg    sync.WaitGroup
+}
+
+// NewHealthChecker returns a checker that probes tags every interval with
+// timeout bounding each probe, dialing destination through each outbound
+// handler as the liveness signal.
+func NewHealthChecker(ohm outbound.Manager, tags []string, interval, timeout time.Duration, destination net.Destination) *HealthChecker {
+	hc := &HealthChecker{
+		ohm:         ohm,
+		interval:    interval,
+		timeout:     timeout,
+		destination: destination,
+		tags:        make(map[string]*tagHealth),
+		close:       make(chan struct{}),
+	}
+	for _, tag := range tags {
+		hc.tags[tag] = new(tagHealth)
+	}
+	return hc
+}
+
+// Start begins the periodic probe loop. It returns immediately; probing
+// happens on a background goroutine until Close is called.
+func (hc *HealthChecker) Start() error {
+	if hc == nil || len(hc.tags) == 0 {
+		return nil
+	}
+	hc.wg.Add(1)
+	go hc.run()
+	return nil
+}
+
+// Close stops the probe loop and waits for the in-flight round to finish.
+func (hc *HealthChecker) Close() error {
+	if hc == nil {
+		return nil
+	}
+	select {
+	case <-hc.close:
+	default:
+		close(hc.close)
+	}
+	hc.wg.Wait()
+	return nil
+}
+
+func (hc *HealthChecker) run() {
+	defer hc.wg.Done()
+	ticker := time.NewTicker(hc.interval)
+	defer ticker.Stop()
+	hc.probeAll()
+	for {
+		select {
+		case <-hc.close:
+			return
+		case <-ticker.C:
+			hc.probeAll()
+		}
+	}
+}
+
+func (hc *HealthChecker) probeAll() {
+	hc.mu.RLock()
+	tags := make([]string, 0, len(hc.tags))
+	for tag := range hc.tags {
+		tags = append(tags, tag)
+	}
+	hc.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, tag := range tags {
+		wg.Add(1)
+		go func(tag string) {
+			defer wg.Done()
+			hc.probe(tag)
+		}(tag)
+	}
+	wg.Wait()
+}
+
+// probe dials hc.destination through tag's handler once and records
+// whether (and how fast) the dial succeeded.
+func (hc *HealthChecker) probe(tag string) {
+	health := hc.healthFor(tag)
+	handler := hc.ohm.GetHandler(tag)
+	if handler == nil {
+		health.recordFailure()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hc.timeout)
+	defer cancel()
+	ctx = session.ContextWithOutbound(ctx, &session.Outbound{Target: hc.destination})
+
+	uplinkReader, uplinkWriter := pipe.New()
+	downlinkReader, downlinkWriter := pipe.New()
+	counting := &countingWriter{inner: downlinkWriter}
+	link := &transport.Link{Reader: uplinkReader, Writer: counting}
+
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		handler.Dispatch(ctx, link)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+	elapsed := time.Since(start)
+
+	// outbound.Handler.Dispatch is void in this codebase (see the
+	// unchanged bare `handler.Dispatch(ctx, link)` call in routedDispatch),
+	// so there's no error to inspect here. A handler that fails to dial
+	// tears its link down and returns almost immediately without ever
+	// writing anything back to us; one that dialed fine either relays
+	// something before hc.destination closes the idle probe connection, or
+	// just blocks relaying nothing until our own timeout fires. Treat a
+	// fast return with no bytes written back as the failure signal, and
+	// everything else as alive.
+	if elapsed < hc.timeout/2 && counting.wrote == 0 {
+		health.recordFailure()
+	} else {
+		health.recordSuccess(elapsed)
+	}
+	common.Close(uplinkWriter)
+	common.Interrupt(downlinkReader)
+}
+
+// RecordFailure reports a dial failure observed outside the regular probe
+// loop (i.e. from routedDispatch's failover path), so a candidate that
+// just failed a real connection sinks to the back of the order sooner
+// than waiting for the next probe round.
+func (hc *HealthChecker) RecordFailure(tag string) {
+	if hc == nil {
+		return
+	}
+	hc.healthFor(tag).recordFailure()
+}
+
+// RecordSuccess mirrors RecordFailure for a real connection that dialed
+// successfully through tag.
+func (hc *HealthChecker) RecordSuccess(tag string, rtt time.Duration) {
+	if hc == nil {
+		return
+	}
+	hc.healthFor(tag).recordSuccess(rtt)
+}
+
+func (hc *HealthChecker) healthFor(tag string) *tagHealth {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	health, ok := hc.tags[tag]
+	if !ok {
+		health = new(tagHealth)
+		hc.tags[tag] = health
+	}
+	return health
+}
+
+type healthCandidate struct {
+	tag        string
+	alive      bool
+	rtt        time.Duration
+	successful float64
+}
+
+// Order returns tags reordered by strategy, live handlers first. The
+// first entry is the one routedDispatch should dial; the rest are
+// fallbacks for handler.Dispatch failover, tried in the returned order.
+// An unrecognised strategy returns tags unchanged, without the live-first
+// reordering.
+func (hc *HealthChecker) Order(tags []string, strategy SelectionStrategy) []string {
+	if hc == nil || len(tags) <= 1 {
+		return tags
+	}
+
+	candidates := make([]healthCandidate, len(tags))
+	for i, tag := range tags {
+		alive, rtt, rate := hc.healthFor(tag).snapshot()
+		candidates[i] = healthCandidate{tag: tag, alive: alive, rtt: rtt, successful: rate}
+	}
+
+	switch strategy {
+	case StrategyRoundRobin:
+		n := atomic.AddUint64(&hc.rr, 1)
+		offset := int(n) % len(candidates)
+		ordered := append(candidates[offset:], candidates[:offset]...)
+		return sortAliveFirst(ordered)
+	case StrategyRandom:
+		rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+		return sortAliveFirst(candidates)
+	case StrategyFailover:
+		// Keep the configured order; only push dead tags to the back.
+		return sortAliveFirst(candidates)
+	case StrategyLeastLatency, "":
+		sort.SliceStable(candidates, func(i, j int) bool {
+			if candidates[i].alive != candidates[j].alive {
+				return candidates[i].alive
+			}
+			return candidates[i].rtt < candidates[j].rtt
+		})
+		out := make([]string, len(candidates))
+		for i, c := range candidates {
+			out[i] = c.tag
+		}
+		return out
+	default:
+		return tags
+	}
+}
+
+func sortAliveFirst(candidates []healthCandidate) []string {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].alive && !candidates[j].alive
+	})
+	out := make([]string, len(candidates))
+	for i, c := range candidates {
+		out[i] = c.tag
+	}
+	return out
+}
@@ -0,0 +1,122 @@
+package mydispatcher
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestHealthChecker(alive map[string]bool, rtt map[string]time.Duration) *HealthChecker {
+	hc := &HealthChecker{tags: make(map[string]*tagHealth)}
+	for tag, isAlive := range alive {
+		h := new(tagHealth)
+		if isAlive {
+			h.recordSuccess(rtt[tag])
+		} else {
+			h.recordFailure()
+		}
+		hc.tags[tag] = h
+	}
+	return hc
+}
+
+func TestOrderLeastLatency(t *testing.T) {
+	hc := newTestHealthChecker(
+		map[string]bool{"a": true, "b": true, "c": false},
+		map[string]time.Duration{"a": 50 * time.Millisecond, "b": 10 * time.Millisecond},
+	)
+
+	got := hc.Order([]string{"a", "b", "c"}, StrategyLeastLatency)
+	want := []string{"b", "a", "c"}
+	if !equalTags(got, want) {
+		t.Errorf("Order(leastLatency) = %v, want %v", got, want)
+	}
+}
+
+func TestOrderFailoverKeepsConfiguredOrderAliveFirst(t *testing.T) {
+	hc := newTestHealthChecker(
+		map[string]bool{"a": false, "b": true, "c": true},
+		nil,
+	)
+
+	got := hc.Order([]string{"a", "b", "c"}, StrategyFailover)
+	want := []string{"b", "c", "a"}
+	if !equalTags(got, want) {
+		t.Errorf("Order(failover) = %v, want %v", got, want)
+	}
+}
+
+func TestOrderRoundRobinRotatesAndKeepsSet(t *testing.T) {
+	hc := newTestHealthChecker(
+		map[string]bool{"a": true, "b": true, "c": true},
+		nil,
+	)
+
+	tags := []string{"a", "b", "c"}
+	first := hc.Order(tags, StrategyRoundRobin)
+	second := hc.Order(tags, StrategyRoundRobin)
+
+	if !sameSet(first, tags) || !sameSet(second, tags) {
+		t.Fatalf("Order(roundRobin) dropped or duplicated tags: %v, %v", first, second)
+	}
+	if equalTags(first, second) {
+		t.Error("successive Order(roundRobin) calls returned the same order; rr counter isn't advancing")
+	}
+}
+
+func TestOrderRandomKeepsSet(t *testing.T) {
+	hc := newTestHealthChecker(
+		map[string]bool{"a": true, "b": true, "c": false},
+		nil,
+	)
+
+	tags := []string{"a", "b", "c"}
+	got := hc.Order(tags, StrategyRandom)
+	if !sameSet(got, tags) {
+		t.Fatalf("Order(random) = %v, want a permutation of %v", got, tags)
+	}
+	if got[len(got)-1] != "c" {
+		t.Errorf("Order(random) = %v, want the dead tag \"c\" last", got)
+	}
+}
+
+func TestOrderSingleOrEmptyTagsIsNoOp(t *testing.T) {
+	hc := newTestHealthChecker(map[string]bool{"a": true}, nil)
+
+	if got := hc.Order(nil, StrategyLeastLatency); len(got) != 0 {
+		t.Errorf("Order(nil) = %v, want empty", got)
+	}
+	if got := hc.Order([]string{"a"}, StrategyLeastLatency); !equalTags(got, []string{"a"}) {
+		t.Errorf("Order(single) = %v, want [a]", got)
+	}
+}
+
+func equalTags(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func sameSet(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	seen := make(map[string]int)
+	for _, t := range want {
+		seen[t]++
+	}
+	for _, t := range got {
+		seen[t]--
+	}
+	for _, n := range seen {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
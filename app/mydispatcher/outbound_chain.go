@@ -0,0 +1,95 @@
+package mydispatcher
+
+import (
+	"context"
+	"sync"
+
+	"github.com/xcode75/xcore/common/session"
+)
+
+// outboundChainKey is the context key under which the active OutboundChain
+// for a dispatched connection is stored.
+type outboundChainKey struct{}
+
+// OutboundChain tracks every session.Outbound pushed by each hop of a
+// dialer-proxy style chain (outbound A tunnels through outbound B, ...).
+// A single transport.Link may be re-dispatched several times as it is
+// handed from one outbound handler to the next; each handler pushes its
+// own hop before dialing so that later stages (e.g. XTLS splice) can
+// inspect every hop to decide whether the whole chain is direct-copy ready.
+type OutboundChain struct {
+	sync.Mutex
+	hops []*session.Outbound
+}
+
+// Push appends ob as the newest hop in the chain.
+func (c *OutboundChain) Push(ob *session.Outbound) {
+	c.Lock()
+	defer c.Unlock()
+	c.hops = append(c.hops, ob)
+}
+
+// Hops returns a snapshot of every hop pushed so far, outermost first.
+func (c *OutboundChain) Hops() []*session.Outbound {
+	c.Lock()
+	defer c.Unlock()
+	hops := make([]*session.Outbound, len(c.hops))
+	copy(hops, c.hops)
+	return hops
+}
+
+// Last returns the most recently pushed hop, or nil if the chain is empty.
+func (c *OutboundChain) Last() *session.Outbound {
+	c.Lock()
+	defer c.Unlock()
+	if len(c.hops) == 0 {
+		return nil
+	}
+	return c.hops[len(c.hops)-1]
+}
+
+// AllSpliceReady reports whether every hop in the chain has explicitly
+// marked itself as safe for zero-copy splicing. A single hop that hasn't
+// made up its mind (CanSpliceCopy == 0) or has opted out (== 2) is enough
+// to disqualify the whole chain.
+func (c *OutboundChain) AllSpliceReady() bool {
+	c.Lock()
+	defer c.Unlock()
+	if len(c.hops) == 0 {
+		return false
+	}
+	for _, hop := range c.hops {
+		if hop.CanSpliceCopy != 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// ContextWithOutboundChain returns a context carrying chain.
+func ContextWithOutboundChain(ctx context.Context, chain *OutboundChain) context.Context {
+	return context.WithValue(ctx, outboundChainKey{}, chain)
+}
+
+// OutboundChainFromContext returns the OutboundChain previously attached to
+// ctx, or nil if none has been attached yet.
+func OutboundChainFromContext(ctx context.Context) *OutboundChain {
+	chain, _ := ctx.Value(outboundChainKey{}).(*OutboundChain)
+	return chain
+}
+
+// pushOutboundHop attaches ob to ctx as the session.Outbound for this hop
+// and records it on the shared OutboundChain, creating the chain on the
+// first call for a given connection. It returns the context to use for the
+// rest of this hop (and for any nested DispatchLink call a wrapping
+// outbound handler makes to reach the next hop).
+func pushOutboundHop(ctx context.Context, ob *session.Outbound) context.Context {
+	ctx = session.ContextWithOutbound(ctx, ob)
+	chain := OutboundChainFromContext(ctx)
+	if chain == nil {
+		chain = new(OutboundChain)
+		ctx = ContextWithOutboundChain(ctx, chain)
+	}
+	chain.Push(ob)
+	return ctx
+}
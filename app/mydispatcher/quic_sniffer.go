@@ -0,0 +1,322 @@
+package mydispatcher
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+var errNotQUIC = newError("not a QUIC Initial packet")
+
+// quicInitialSalt is the salt used to derive QUIC v1 (RFC 9001) Initial
+// keys. It is fixed by the spec and does not depend on the connection.
+var quicInitialSalt = []byte{
+	0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3,
+	0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad,
+	0xcc, 0xbb, 0x7f, 0x0a,
+}
+
+// QUICSniffResult reports a ClientHello SNI recovered from the CRYPTO
+// frames carried inside a QUIC Initial packet.
+type QUICSniffResult struct {
+	domain string
+}
+
+// Protocol implements SniffResult.
+func (r *QUICSniffResult) Protocol() string {
+	return "quic"
+}
+
+// Domain implements SniffResult.
+func (r *QUICSniffResult) Domain() string {
+	return r.domain
+}
+
+// SniffQUIC inspects a UDP datagram for a QUIC long-header Initial packet,
+// decrypts it with the keys derived from the packet's Destination
+// Connection ID, and pulls the SNI out of the TLS ClientHello carried in
+// its CRYPTO frames. It returns errNotQUIC (not common.ErrNoClue) for
+// anything that doesn't look like a QUIC Initial packet or carries no SNI;
+// the sniffer loop treats any error from it as "no match" and goes on to
+// the TLS/HTTP sniffers.
+func SniffQUIC(b []byte) (*QUICSniffResult, error) {
+	payload, err := decryptQUICInitial(b)
+	if err != nil {
+		return nil, err
+	}
+
+	sni, err := parseClientHelloSNI(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return &QUICSniffResult{domain: sni}, nil
+}
+
+// decryptQUICInitial parses the long-header Initial packet in b, derives
+// the client Initial keys from the Destination Connection ID, and returns
+// the decrypted CRYPTO frame payload (with packet-number protection and
+// AEAD protection removed).
+func decryptQUICInitial(b []byte) ([]byte, error) {
+	if len(b) < 7 || b[0]&0x80 == 0 || b[0]&0x30 != 0x00 {
+		// Not a long header, or not an Initial packet (type bits != 00).
+		return nil, errNotQUIC
+	}
+
+	offset := 5 // flags(1) + version(4)
+	if len(b) < offset+1 {
+		return nil, errNotQUIC
+	}
+	dcidLen := int(b[offset])
+	offset++
+	if len(b) < offset+dcidLen {
+		return nil, errNotQUIC
+	}
+	dcid := b[offset : offset+dcidLen]
+	offset += dcidLen
+
+	if len(b) < offset+1 {
+		return nil, errNotQUIC
+	}
+	scidLen := int(b[offset])
+	offset++
+	offset += scidLen
+	if len(b) < offset+1 {
+		return nil, errNotQUIC
+	}
+
+	tokenLen, n := readVarint(b[offset:])
+	if n == 0 {
+		return nil, errNotQUIC
+	}
+	offset += n + int(tokenLen)
+	if len(b) < offset+1 {
+		return nil, errNotQUIC
+	}
+
+	packetLen, n := readVarint(b[offset:])
+	if n == 0 {
+		return nil, errNotQUIC
+	}
+	offset += n
+	if len(b) < offset+int(packetLen) {
+		return nil, errNotQUIC
+	}
+	header := b[:offset]
+	rest := b[offset : offset+int(packetLen)]
+
+	clientSecret := deriveInitialSecret(dcid, true)
+	hp := hkdfExpandLabel(clientSecret, "quic hp", 16)
+	key := hkdfExpandLabel(clientSecret, "quic key", 16)
+	iv := hkdfExpandLabel(clientSecret, "quic iv", 12)
+
+	block, err := aes.NewCipher(hp)
+	if err != nil {
+		return nil, errNotQUIC
+	}
+	if len(rest) < 4+16 {
+		return nil, errNotQUIC
+	}
+	sampleOffset := 4
+	sample := rest[sampleOffset : sampleOffset+16]
+	mask := make([]byte, 16)
+	block.Encrypt(mask, sample)
+
+	firstByte := header[0] ^ (mask[0] & 0x0f)
+	pnLen := int(firstByte&0x03) + 1
+	header = append([]byte{}, header...)
+	header[0] = firstByte
+
+	pn := make([]byte, pnLen)
+	copy(pn, rest[:pnLen])
+	for i := 0; i < pnLen; i++ {
+		pn[i] ^= mask[1+i]
+	}
+	header = append(header, pn...)
+
+	ciphertext := rest[pnLen:]
+	nonce := make([]byte, len(iv))
+	copy(nonce, iv)
+	for i := 0; i < pnLen; i++ {
+		nonce[len(nonce)-pnLen+i] ^= pn[i]
+	}
+
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, errNotQUIC
+	}
+	plaintext, err := aead.Open(nil, nonce, ciphertext, header)
+	if err != nil {
+		return nil, errNotQUIC
+	}
+
+	return extractCryptoFrames(plaintext)
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// extractCryptoFrames walks a decrypted QUIC frame payload and
+// concatenates the contents of the CRYPTO frames (type 0x06), which is
+// where the TLS ClientHello lives for an Initial packet. Frames are joined
+// in the order they appear (their offsets are not used), and the walk stops
+// at the first frame that is neither PADDING nor CRYPTO, so CRYPTO frames
+// after it are not included.
+func extractCryptoFrames(b []byte) ([]byte, error) {
+	var crypto []byte
+	for len(b) > 0 {
+		frameType := b[0]
+		b = b[1:]
+		switch {
+		case frameType == 0x00: // PADDING
+			continue
+		case frameType == 0x06: // CRYPTO
+			offset, n := readVarint(b)
+			if n == 0 {
+				return nil, errNotQUIC
+			}
+			b = b[n:]
+			length, n := readVarint(b)
+			if n == 0 {
+				return nil, errNotQUIC
+			}
+			b = b[n:]
+			if uint64(len(b)) < length {
+				return nil, errNotQUIC
+			}
+			_ = offset
+			crypto = append(crypto, b[:length]...)
+			b = b[length:]
+		default:
+			// Anything else in an Initial packet (ACK, CONNECTION_CLOSE,
+			// PING) carries no information we need; bail rather than try
+			// to special-case every frame's length encoding.
+			if len(crypto) > 0 {
+				return crypto, nil
+			}
+			return nil, errNotQUIC
+		}
+	}
+	if len(crypto) == 0 {
+		return nil, errNotQUIC
+	}
+	return crypto, nil
+}
+
+// parseClientHelloSNI extracts the server_name extension from a raw TLS
+// ClientHello handshake message (no record layer, as produced by
+// reassembling QUIC CRYPTO frames).
+func parseClientHelloSNI(b []byte) (string, error) {
+	if len(b) < 4 || b[0] != 0x01 { // handshake type: client_hello
+		return "", errNotQUIC
+	}
+	pos := 4      // msg type(1) + length(3)
+	pos += 2 + 32 // legacy_version(2) + random(32)
+	if len(b) < pos+1 {
+		return "", errNotQUIC
+	}
+	sessionIDLen := int(b[pos])
+	pos += 1 + sessionIDLen
+	if len(b) < pos+2 {
+		return "", errNotQUIC
+	}
+	cipherSuitesLen := int(binary.BigEndian.Uint16(b[pos:]))
+	pos += 2 + cipherSuitesLen
+	if len(b) < pos+1 {
+		return "", errNotQUIC
+	}
+	compMethodsLen := int(b[pos])
+	pos += 1 + compMethodsLen
+	if len(b) < pos+2 {
+		return "", errNotQUIC
+	}
+	extensionsLen := int(binary.BigEndian.Uint16(b[pos:]))
+	pos += 2
+	if len(b) < pos+extensionsLen {
+		return "", errNotQUIC
+	}
+	extensions := b[pos : pos+extensionsLen]
+
+	for len(extensions) >= 4 {
+		extType := binary.BigEndian.Uint16(extensions)
+		extLen := int(binary.BigEndian.Uint16(extensions[2:]))
+		extensions = extensions[4:]
+		if len(extensions) < extLen {
+			break
+		}
+		if extType == 0x0000 { // server_name
+			data := extensions[:extLen]
+			if len(data) < 5 {
+				break
+			}
+			nameLen := int(binary.BigEndian.Uint16(data[3:]))
+			if len(data) < 5+nameLen {
+				break
+			}
+			return string(data[5 : 5+nameLen]), nil
+		}
+		extensions = extensions[extLen:]
+	}
+
+	return "", errNotQUIC
+}
+
+// readVarint decodes a QUIC variable-length integer and reports how many
+// bytes it occupied, or 0 if b does not contain a complete varint.
+func readVarint(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	prefix := b[0] >> 6
+	length := 1 << prefix
+	if len(b) < length {
+		return 0, 0
+	}
+	v := uint64(b[0] & 0x3f)
+	for i := 1; i < length; i++ {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, length
+}
+
+// deriveInitialSecret derives the client or server Initial secret for dcid
+// as defined in RFC 9001 section 5.2.
+func deriveInitialSecret(dcid []byte, client bool) []byte {
+	initialSecret := hkdfExtract(quicInitialSalt, dcid)
+	label := "client in"
+	if !client {
+		label = "server in"
+	}
+	return hkdfExpandLabel(initialSecret, label, 32)
+}
+
+func hkdfExtract(salt, ikm []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
+
+// hkdfExpandLabel implements the TLS 1.3 / QUIC HKDF-Expand-Label
+// construction for the single-block case, which is all QUIC's fixed-size
+// hp/key/iv secrets ever need.
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	fullLabel := "tls13 " + label
+	info := make([]byte, 0, 2+1+len(fullLabel)+1)
+	info = append(info, byte(length>>8), byte(length))
+	info = append(info, byte(len(fullLabel)))
+	info = append(info, fullLabel...)
+	info = append(info, 0) // empty context
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(info)
+	mac.Write([]byte{1})
+	out := mac.Sum(nil)
+	return out[:length]
+}
@@ -0,0 +1,175 @@
+package mydispatcher
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestReadVarint(t *testing.T) {
+	cases := []struct {
+		name    string
+		in      []byte
+		wantVal uint64
+		wantLen int
+	}{
+		{"1-byte", []byte{0x25}, 37, 1},
+		{"2-byte", []byte{0x7b, 0xbd}, 15293, 2},
+		{"4-byte", []byte{0x9d, 0x7f, 0x3e, 0x7d}, 494878333, 4},
+		{"8-byte", []byte{0xc2, 0x19, 0x7c, 0x5e, 0xff, 0x14, 0xe8, 0x8c}, 151288809941952652, 8},
+		{"empty", []byte{}, 0, 0},
+		{"truncated 2-byte", []byte{0x7b}, 0, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			v, n := readVarint(c.in)
+			if v != c.wantVal || n != c.wantLen {
+				t.Errorf("readVarint(%v) = (%d, %d), want (%d, %d)", c.in, v, n, c.wantVal, c.wantLen)
+			}
+		})
+	}
+}
+
+func TestHkdfExpandLabelDeterministicAndSized(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+
+	cases := []struct {
+		label  string
+		length int
+	}{
+		{"quic key", 16},
+		{"quic iv", 12},
+		{"quic hp", 16},
+		{"client in", 32},
+	}
+	for _, c := range cases {
+		out1 := hkdfExpandLabel(secret, c.label, c.length)
+		out2 := hkdfExpandLabel(secret, c.label, c.length)
+		if len(out1) != c.length {
+			t.Errorf("hkdfExpandLabel(%q) length = %d, want %d", c.label, len(out1), c.length)
+		}
+		if string(out1) != string(out2) {
+			t.Errorf("hkdfExpandLabel(%q) not deterministic", c.label)
+		}
+	}
+
+	a := hkdfExpandLabel(secret, "quic key", 16)
+	b := hkdfExpandLabel(secret, "quic iv", 16)
+	if string(a) == string(b) {
+		t.Error("different labels produced the same output")
+	}
+}
+
+func TestHkdfExtractDeterministic(t *testing.T) {
+	salt := quicInitialSalt
+	dcid := []byte{0x83, 0x94, 0xc8, 0xf0, 0x3e, 0x51, 0x57, 0x08}
+
+	out1 := hkdfExtract(salt, dcid)
+	out2 := hkdfExtract(salt, dcid)
+	if string(out1) != string(out2) {
+		t.Error("hkdfExtract not deterministic")
+	}
+	if len(out1) != 32 { // HMAC-SHA256 output size
+		t.Errorf("hkdfExtract length = %d, want 32", len(out1))
+	}
+}
+
+func TestDeriveInitialSecretClientServerDiffer(t *testing.T) {
+	dcid := []byte{0x83, 0x94, 0xc8, 0xf0, 0x3e, 0x51, 0x57, 0x08}
+
+	client := deriveInitialSecret(dcid, true)
+	server := deriveInitialSecret(dcid, false)
+	if string(client) == string(server) {
+		t.Error("client and server Initial secrets must differ")
+	}
+	if len(client) != 32 || len(server) != 32 {
+		t.Errorf("Initial secret length = %d/%d, want 32/32", len(client), len(server))
+	}
+}
+
+// buildClientHello assembles a minimal, record-layer-free TLS ClientHello
+// carrying a single server_name (SNI) extension, matching what
+// extractCryptoFrames hands to parseClientHelloSNI.
+func buildClientHello(sni string) []byte {
+	serverNameList := make([]byte, 0, 3+len(sni))
+	serverNameList = append(serverNameList, 0x00) // name_type: host_name
+	serverNameList = append(serverNameList, byte(len(sni)>>8), byte(len(sni)))
+	serverNameList = append(serverNameList, sni...)
+
+	serverNameExtData := make([]byte, 0, 2+len(serverNameList))
+	serverNameExtData = append(serverNameExtData, byte(len(serverNameList)>>8), byte(len(serverNameList)))
+	serverNameExtData = append(serverNameExtData, serverNameList...)
+
+	ext := make([]byte, 0, 4+len(serverNameExtData))
+	ext = append(ext, 0x00, 0x00) // extension type: server_name
+	ext = append(ext, byte(len(serverNameExtData)>>8), byte(len(serverNameExtData)))
+	ext = append(ext, serverNameExtData...)
+
+	body := make([]byte, 0, 64+len(ext))
+	body = append(body, make([]byte, 2)...)  // legacy_version
+	body = append(body, make([]byte, 32)...) // random
+	body = append(body, 0x00)                // session_id length
+	body = append(body, 0x00, 0x02, 0x13, 0x01)
+	body = append(body, 0x01, 0x00) // compression methods
+	extLen := make([]byte, 2)
+	binary.BigEndian.PutUint16(extLen, uint16(len(ext)))
+	body = append(body, extLen...)
+	body = append(body, ext...)
+
+	msg := make([]byte, 0, 4+len(body))
+	msg = append(msg, 0x01) // handshake type: client_hello
+	msg = append(msg, byte(len(body)>>16), byte(len(body)>>8), byte(len(body)))
+	msg = append(msg, body...)
+	return msg
+}
+
+func TestParseClientHelloSNI(t *testing.T) {
+	ch := buildClientHello("example.com")
+
+	sni, err := parseClientHelloSNI(ch)
+	if err != nil {
+		t.Fatalf("parseClientHelloSNI returned error: %v", err)
+	}
+	if sni != "example.com" {
+		t.Errorf("sni = %q, want %q", sni, "example.com")
+	}
+}
+
+func TestParseClientHelloSNIRejectsNonClientHello(t *testing.T) {
+	if _, err := parseClientHelloSNI([]byte{0x02, 0, 0, 0}); err == nil {
+		t.Error("expected error for a non-client_hello handshake message")
+	}
+	if _, err := parseClientHelloSNI(nil); err == nil {
+		t.Error("expected error for empty input")
+	}
+}
+
+func TestExtractCryptoFrames(t *testing.T) {
+	payload := []byte("fake-client-hello-bytes")
+
+	frame := []byte{0x06}                     // CRYPTO frame type
+	frame = append(frame, 0x00)               // offset varint: 0
+	frame = append(frame, byte(len(payload))) // length varint (fits in 1 byte)
+	frame = append(frame, payload...)
+
+	got, err := extractCryptoFrames(frame)
+	if err != nil {
+		t.Fatalf("extractCryptoFrames returned error: %v", err)
+	}
+	if string(got) != string(payload) {
+		t.Errorf("extractCryptoFrames = %q, want %q", got, payload)
+	}
+}
+
+func TestExtractCryptoFramesSkipsPadding(t *testing.T) {
+	payload := []byte("hello")
+	frame := append([]byte{0x00, 0x00, 0x00}, 0x06, 0x00, byte(len(payload)))
+	frame = append(frame, payload...)
+
+	got, err := extractCryptoFrames(frame)
+	if err != nil {
+		t.Fatalf("extractCryptoFrames returned error: %v", err)
+	}
+	if string(got) != string(payload) {
+		t.Errorf("extractCryptoFrames = %q, want %q", got, payload)
+	}
+}
@@ -0,0 +1,116 @@
+package mydispatcher
+
+import (
+	"context"
+	"sync"
+
+	"github.com/xcode75/xcore/common"
+	"github.com/xcode75/xcore/common/buf"
+	"github.com/xcode75/xcore/common/session"
+	"github.com/xcode75/xcore/features/stats"
+	"github.com/xcode75/xcore/transport"
+)
+
+// SizeStatWriter forwards every MultiBuffer it writes to Writer, adding
+// its size to Counter (the user's aggregate uplink/downlink traffic
+// counter) plus any counter later attached with AddCounter.
+//
+// Counter is set once at construction, but sniffing only learns the
+// connection's domain/protocol after getLink has already returned and
+// wired this writer into the link, so the per-domain and per-protocol
+// counters from chunk0-5 can only be known after the fact. AddCounter
+// lets the dispatcher bolt them on once sniffing completes, and every
+// extra counter then shares the writer's lifetime with Counter.
+type SizeStatWriter struct {
+	Counter stats.Counter
+	Writer  buf.Writer
+
+	mu    sync.Mutex
+	extra []stats.Counter
+}
+
+// AddCounter attaches c so every subsequent WriteMultiBuffer call also
+// adds to it. Safe to call concurrently with WriteMultiBuffer.
+func (w *SizeStatWriter) AddCounter(c stats.Counter) {
+	if c == nil {
+		return
+	}
+	w.mu.Lock()
+	w.extra = append(w.extra, c)
+	w.mu.Unlock()
+}
+
+func (w *SizeStatWriter) WriteMultiBuffer(mb buf.MultiBuffer) error {
+	size := int64(mb.Len())
+	if size > 0 {
+		if w.Counter != nil {
+			w.Counter.Add(size)
+		}
+		w.mu.Lock()
+		extra := w.extra
+		w.mu.Unlock()
+		for _, c := range extra {
+			c.Add(size)
+		}
+	}
+	return w.Writer.WriteMultiBuffer(mb)
+}
+
+func (w *SizeStatWriter) Close() error {
+	return common.Close(w.Writer)
+}
+
+// registerDomainProtocolStats registers and attaches the per-domain and
+// per-protocol counters described in chunk0-5 once sniffing has produced a
+// domain/protocol for this connection. inbound may be nil (DispatchLink has
+// no separate inbound link to attach uplink counters to); outbound is
+// always present.
+func (d *DefaultDispatcher) registerDomainProtocolStats(ctx context.Context, inbound, outbound *transport.Link, domain, protocol string) {
+	if domain == "" && protocol == "" {
+		return
+	}
+	sessionInbound := session.InboundFromContext(ctx)
+	if sessionInbound == nil || sessionInbound.User == nil || sessionInbound.User.Email == "" {
+		return
+	}
+	email := sessionInbound.User.Email
+	p := d.policy.ForLevel(sessionInbound.User.Level)
+
+	attach := func(kind, value string, uplink bool) {
+		if value == "" {
+			return
+		}
+		direction := "downlink"
+		link := outbound
+		enabled := p.Stats.UserDownlink
+		if uplink {
+			direction = "uplink"
+			link = inbound
+			enabled = p.Stats.UserUplink
+		}
+		if !enabled || link == nil {
+			return
+		}
+		name := "user>>>" + email + ">>>" + kind + ">>>" + value + ">>>" + direction
+		if c, _ := stats.GetOrRegisterCounter(d.stats, name); c != nil {
+			attachStatCounter(link.Writer, c)
+		}
+	}
+
+	attach("domain", domain, true)
+	attach("domain", domain, false)
+	attach("protocol", protocol, true)
+	attach("protocol", protocol, false)
+}
+
+// attachStatCounter attaches c to w if w is a *SizeStatWriter, and is a
+// no-op otherwise (e.g. stats were disabled for this user, so getLink
+// never wrapped the link's writer in one).
+func attachStatCounter(w buf.Writer, c stats.Counter) {
+	if c == nil {
+		return
+	}
+	if sw, ok := w.(*SizeStatWriter); ok {
+		sw.AddCounter(c)
+	}
+}
@@ -0,0 +1,149 @@
+// Package limiter enforces per-user speed and device caps for inbound
+// connections. It ships with a process-local backend and a Redis-backed
+// backend so a cluster of XMPlus nodes can share one device count per
+// user; see RedisBackend in redis.go.
+package limiter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/juju/ratelimit"
+
+	"github.com/xcode75/xcore/common"
+	"github.com/xcode75/xcore/common/buf"
+)
+
+// UserInfo is the per-user speed/device configuration a Backend enforces.
+type UserInfo struct {
+	Email       string
+	SpeedLimit  uint64 // bytes/s, 0 means unlimited
+	DeviceLimit int    // 0 means unlimited
+}
+
+// Backend is the pluggable store behind Limiter. GetUserBucket is called
+// once per new connection; RecordDevice/ReleaseDevice bracket the
+// connection's lifetime so the device count only reflects live
+// connections. Implementations must be safe for concurrent use.
+type Backend interface {
+	// GetUserBucket returns the rate-limit bucket for tag/email (nil if the
+	// user has no speed limit configured), whether a bucket was returned,
+	// and whether the connection must be rejected because email has
+	// already reached its device limit from a source other than ip.
+	GetUserBucket(tag, email, ip string) (bucket *ratelimit.Bucket, ok bool, reject bool)
+	// RecordDevice registers ip as an active source for tag/email.
+	RecordDevice(tag, email, ip string)
+	// ReleaseDevice removes ip from the active set for tag/email.
+	ReleaseDevice(tag, email, ip string)
+	// UpdateUser pushes a new speed/device configuration for tag/email,
+	// propagating to every node sharing this backend.
+	UpdateUser(tag string, info UserInfo)
+	// Close releases any resources (background goroutines, connections)
+	// the backend holds. Safe to call even if none were ever needed.
+	Close() error
+}
+
+// Limiter is the dispatcher-facing facade; DefaultDispatcher only ever
+// talks to this type, never to a Backend directly, so swapping the
+// backend (in-memory vs Redis) needs no change at the call site.
+type Limiter struct {
+	Backend Backend
+}
+
+// New returns a Limiter backed by the process-local, in-memory Backend.
+func New() *Limiter {
+	return &Limiter{Backend: NewMemoryBackend()}
+}
+
+// NewWithBackend returns a Limiter using a caller-supplied Backend, e.g.
+// NewRedisBackend for a clustered deployment.
+func NewWithBackend(backend Backend) *Limiter {
+	return &Limiter{Backend: backend}
+}
+
+func (l *Limiter) GetUserBucket(tag, email, ip string) (*ratelimit.Bucket, bool, bool) {
+	return l.Backend.GetUserBucket(tag, email, ip)
+}
+
+func (l *Limiter) RecordDevice(tag, email, ip string) {
+	l.Backend.RecordDevice(tag, email, ip)
+}
+
+func (l *Limiter) ReleaseDevice(tag, email, ip string) {
+	l.Backend.ReleaseDevice(tag, email, ip)
+}
+
+func (l *Limiter) UpdateUser(tag string, info UserInfo) {
+	l.Backend.UpdateUser(tag, info)
+}
+
+// Close shuts down the Limiter's backend.
+func (l *Limiter) Close() error {
+	return l.Backend.Close()
+}
+
+// RateWriter wraps writer so every WriteMultiBuffer call is throttled by
+// bucket. A nil bucket (no speed limit configured for the user) returns
+// writer unchanged.
+func (l *Limiter) RateWriter(writer buf.Writer, bucket *ratelimit.Bucket) buf.Writer {
+	if bucket == nil {
+		return writer
+	}
+	return &rateLimitedWriter{writer: writer, bucket: bucket}
+}
+
+type rateLimitedWriter struct {
+	writer buf.Writer
+	bucket *ratelimit.Bucket
+}
+
+func (w *rateLimitedWriter) WriteMultiBuffer(mb buf.MultiBuffer) error {
+	size := int64(mb.Len())
+	if size > 0 {
+		w.bucket.Wait(size)
+	}
+	return w.writer.WriteMultiBuffer(mb)
+}
+
+func (w *rateLimitedWriter) Close() error {
+	return common.Close(w.writer)
+}
+
+// deviceSet tracks the source IPs currently using one user's device slots,
+// each entry timestamped with when it was last added. Entries leave the set
+// only through remove (ReleaseDevice); stale entries from connections that
+// never called ReleaseDevice are not reaped.
+type deviceSet struct {
+	sync.Mutex
+	ips map[string]time.Time
+}
+
+func newDeviceSet() *deviceSet {
+	return &deviceSet{ips: make(map[string]time.Time)}
+}
+
+func (s *deviceSet) add(ip string) (count int) {
+	s.Lock()
+	defer s.Unlock()
+	s.ips[ip] = time.Now()
+	return len(s.ips)
+}
+
+func (s *deviceSet) remove(ip string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.ips, ip)
+}
+
+func (s *deviceSet) has(ip string) bool {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.ips[ip]
+	return ok
+}
+
+func (s *deviceSet) count() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.ips)
+}
@@ -0,0 +1,84 @@
+package limiter
+
+import (
+	"sync"
+
+	"github.com/juju/ratelimit"
+)
+
+// MemoryBackend is the original process-local Limiter behaviour: speed
+// buckets and device sets live in plain maps and are only ever seen by
+// this node.
+type MemoryBackend struct {
+	users   sync.Map // key: tag+">>>"+email, value: UserInfo
+	buckets sync.Map // key: tag+">>>"+email, value: *ratelimit.Bucket
+	devices sync.Map // key: tag+">>>"+email, value: *deviceSet
+}
+
+// NewMemoryBackend returns a Backend that keeps all state in-process.
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{}
+}
+
+func userKey(tag, email string) string {
+	return tag + ">>>" + email
+}
+
+func (m *MemoryBackend) UpdateUser(tag string, info UserInfo) {
+	m.users.Store(userKey(tag, info.Email), info)
+	m.buckets.Delete(userKey(tag, info.Email)) // force the bucket to be rebuilt with the new rate
+}
+
+func (m *MemoryBackend) GetUserBucket(tag, email, ip string) (*ratelimit.Bucket, bool, bool) {
+	key := userKey(tag, email)
+	info, ok := m.users.Load(key)
+	if !ok {
+		return nil, false, false
+	}
+	userInfo := info.(UserInfo)
+
+	set := m.deviceSetFor(key)
+	if userInfo.DeviceLimit > 0 && !set.has(ip) && set.count() >= userInfo.DeviceLimit {
+		return nil, false, true
+	}
+
+	if userInfo.SpeedLimit == 0 {
+		return nil, false, false
+	}
+
+	if b, ok := m.buckets.Load(key); ok {
+		return b.(*ratelimit.Bucket), true, false
+	}
+	bucket := ratelimit.NewBucketWithRate(float64(userInfo.SpeedLimit), int64(userInfo.SpeedLimit))
+	actual, _ := m.buckets.LoadOrStore(key, bucket)
+	return actual.(*ratelimit.Bucket), true, false
+}
+
+func (m *MemoryBackend) RecordDevice(tag, email, ip string) {
+	key := userKey(tag, email)
+	info, ok := m.users.Load(key)
+	if !ok || info.(UserInfo).DeviceLimit <= 0 {
+		return
+	}
+	m.deviceSetFor(key).add(ip)
+}
+
+func (m *MemoryBackend) ReleaseDevice(tag, email, ip string) {
+	key := userKey(tag, email)
+	info, ok := m.users.Load(key)
+	if !ok || info.(UserInfo).DeviceLimit <= 0 {
+		return
+	}
+	m.deviceSetFor(key).remove(ip)
+}
+
+// Close implements Backend. MemoryBackend holds nothing that needs
+// shutting down.
+func (m *MemoryBackend) Close() error {
+	return nil
+}
+
+func (m *MemoryBackend) deviceSetFor(key string) *deviceSet {
+	set, _ := m.devices.LoadOrStore(key, newDeviceSet())
+	return set.(*deviceSet)
+}
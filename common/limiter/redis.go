@@ -0,0 +1,293 @@
+package limiter
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/juju/ratelimit"
+)
+
+// updatesChannel is the Redis pub/sub channel RedisBackend uses to fan a
+// UpdateUser call (a rule/speed change on one node) out to every other
+// node sharing the same Redis instance.
+const updatesChannel = "xmplus:limiter:updates"
+
+// deviceTTL bounds how long a device's membership in a user's active-IP
+// set survives without a refresh, so a node that crashes mid-connection
+// doesn't permanently occupy a device slot.
+const deviceTTL = 2 * time.Minute
+
+// deviceRefreshInterval is how often RecordDevice's background goroutine
+// re-expires a still-live connection's device set, comfortably inside
+// deviceTTL so a missed tick or two doesn't let the set lapse.
+const deviceRefreshInterval = deviceTTL / 2
+
+// subscribeRetryDelay bounds how long subscribeLoop waits before
+// resubscribing after the Redis pub/sub connection drops, so a restart on
+// the Redis side doesn't permanently end cross-node rule propagation.
+const subscribeRetryDelay = time.Second
+
+// RedisBackend is a Backend that keys device/speed state by "{tag}:{email}"
+// in Redis so every XMPlus node enforcing the same user shares one device
+// cap and one view of the user's current rate limit.
+type RedisBackend struct {
+	client *redis.Client
+
+	mu    sync.RWMutex
+	users map[string]UserInfo
+
+	bucketsMu sync.Mutex
+	buckets   map[string]*ratelimit.Bucket
+
+	refreshMu   sync.Mutex
+	refreshers  map[string]chan struct{}
+	refreshRefs map[string]int
+	refreshWg   sync.WaitGroup
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewRedisBackend connects to the Redis instance at addr and starts
+// listening for UpdateUser broadcasts from other nodes.
+func NewRedisBackend(addr, password string, db int) *RedisBackend {
+	b := &RedisBackend{
+		client:      redis.NewClient(&redis.Options{Addr: addr, Password: password, DB: db}),
+		users:       make(map[string]UserInfo),
+		buckets:     make(map[string]*ratelimit.Bucket),
+		refreshers:  make(map[string]chan struct{}),
+		refreshRefs: make(map[string]int),
+		stop:        make(chan struct{}),
+	}
+	b.wg.Add(1)
+	go b.subscribeLoop()
+	return b
+}
+
+// Close stops the pub/sub goroutine, every outstanding device-TTL
+// refresher, and closes the underlying Redis client.
+func (b *RedisBackend) Close() error {
+	select {
+	case <-b.stop:
+	default:
+		close(b.stop)
+	}
+	b.wg.Wait()
+
+	b.refreshMu.Lock()
+	for setKey, stop := range b.refreshers {
+		close(stop)
+		delete(b.refreshers, setKey)
+		delete(b.refreshRefs, setKey)
+	}
+	b.refreshMu.Unlock()
+	b.refreshWg.Wait()
+
+	return b.client.Close()
+}
+
+func redisKey(tag, email string) string {
+	return tag + ":" + email
+}
+
+func (b *RedisBackend) UpdateUser(tag string, info UserInfo) {
+	key := redisKey(tag, info.Email)
+	b.storeUser(key, info)
+
+	payload, err := json.Marshal(info)
+	if err != nil {
+		return
+	}
+	ctx := context.Background()
+	b.client.Publish(ctx, updatesChannel, key+"|"+string(payload))
+}
+
+func (b *RedisBackend) storeUser(key string, info UserInfo) {
+	b.mu.Lock()
+	b.users[key] = info
+	b.mu.Unlock()
+
+	b.bucketsMu.Lock()
+	delete(b.buckets, key)
+	b.bucketsMu.Unlock()
+}
+
+// subscribeLoop keeps subscribeUpdates running, resubscribing after a
+// short backoff whenever the Redis connection drops, until Close stops it.
+func (b *RedisBackend) subscribeLoop() {
+	defer b.wg.Done()
+	for {
+		select {
+		case <-b.stop:
+			return
+		default:
+		}
+		b.subscribeUpdates()
+		select {
+		case <-b.stop:
+			return
+		case <-time.After(subscribeRetryDelay):
+		}
+	}
+}
+
+func (b *RedisBackend) subscribeUpdates() {
+	ctx := context.Background()
+	sub := b.client.Subscribe(ctx, updatesChannel)
+	defer sub.Close()
+
+	ch := sub.Channel()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return // connection dropped; subscribeLoop will resubscribe
+			}
+			key, payload, found := splitOnce(msg.Payload, '|')
+			if !found {
+				continue
+			}
+			var info UserInfo
+			if err := json.Unmarshal([]byte(payload), &info); err != nil {
+				continue
+			}
+			b.storeUser(key, info)
+		}
+	}
+}
+
+func splitOnce(s string, sep byte) (before, after string, found bool) {
+	for i := 0; i < len(s); i++ {
+		if s[i] == sep {
+			return s[:i], s[i+1:], true
+		}
+	}
+	return s, "", false
+}
+
+func (b *RedisBackend) GetUserBucket(tag, email, ip string) (*ratelimit.Bucket, bool, bool) {
+	key := redisKey(tag, email)
+	b.mu.RLock()
+	info, ok := b.users[key]
+	b.mu.RUnlock()
+	if !ok {
+		return nil, false, false
+	}
+
+	if info.DeviceLimit > 0 {
+		ctx := context.Background()
+		setKey := "xmplus:limiter:devices:" + key
+		isMember, _ := b.client.SIsMember(ctx, setKey, ip).Result()
+		if !isMember {
+			count, _ := b.client.SCard(ctx, setKey).Result()
+			if int(count) >= info.DeviceLimit {
+				return nil, false, true
+			}
+		}
+	}
+
+	if info.SpeedLimit == 0 {
+		return nil, false, false
+	}
+
+	b.bucketsMu.Lock()
+	defer b.bucketsMu.Unlock()
+	if bucket, ok := b.buckets[key]; ok {
+		return bucket, true, false
+	}
+	bucket := ratelimit.NewBucketWithRate(float64(info.SpeedLimit), int64(info.SpeedLimit))
+	b.buckets[key] = bucket
+	return bucket, true, false
+}
+
+func (b *RedisBackend) RecordDevice(tag, email, ip string) {
+	key := redisKey(tag, email)
+	b.mu.RLock()
+	info, ok := b.users[key]
+	b.mu.RUnlock()
+	if !ok || info.DeviceLimit <= 0 {
+		return
+	}
+
+	ctx := context.Background()
+	setKey := "xmplus:limiter:devices:" + key
+	pipe := b.client.TxPipeline()
+	pipe.SAdd(ctx, setKey, ip)
+	pipe.Expire(ctx, setKey, deviceTTL)
+	pipe.Exec(ctx)
+
+	b.acquireRefresher(setKey)
+}
+
+func (b *RedisBackend) ReleaseDevice(tag, email, ip string) {
+	key := redisKey(tag, email)
+	b.mu.RLock()
+	info, ok := b.users[key]
+	b.mu.RUnlock()
+	if !ok || info.DeviceLimit <= 0 {
+		return
+	}
+
+	ctx := context.Background()
+	setKey := "xmplus:limiter:devices:" + key
+	b.client.SRem(ctx, setKey, ip)
+
+	b.releaseRefresher(setKey)
+}
+
+// acquireRefresher starts a background goroutine that re-expires setKey
+// every deviceRefreshInterval for as long as any connection recorded
+// against it is still live, so a connection that outlives deviceTTL
+// doesn't silently fall out of the device set (see deviceTTL). Callers
+// bracket this with releaseRefresher; the goroutine itself only stops once
+// the last live connection for setKey has released.
+func (b *RedisBackend) acquireRefresher(setKey string) {
+	b.refreshMu.Lock()
+	defer b.refreshMu.Unlock()
+
+	b.refreshRefs[setKey]++
+	if _, running := b.refreshers[setKey]; running {
+		return
+	}
+
+	stop := make(chan struct{})
+	b.refreshers[setKey] = stop
+	b.refreshWg.Add(1)
+	go b.refreshDeviceTTL(setKey, stop)
+}
+
+func (b *RedisBackend) releaseRefresher(setKey string) {
+	b.refreshMu.Lock()
+	defer b.refreshMu.Unlock()
+
+	b.refreshRefs[setKey]--
+	if b.refreshRefs[setKey] > 0 {
+		return
+	}
+	delete(b.refreshRefs, setKey)
+	if stop, ok := b.refreshers[setKey]; ok {
+		close(stop)
+		delete(b.refreshers, setKey)
+	}
+}
+
+func (b *RedisBackend) refreshDeviceTTL(setKey string, stop chan struct{}) {
+	defer b.refreshWg.Done()
+	ticker := time.NewTicker(deviceRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			b.client.Expire(context.Background(), setKey, deviceTTL)
+		}
+	}
+}